@@ -0,0 +1,186 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "fmt"
+
+// ObjectAccessControl is a single ACL entry on an object, matching the
+// shape of the GCS objectAccessControls resource.
+type ObjectAccessControl struct {
+	Entity string
+	Role   string
+}
+
+// IAMPolicy is a minimal stand-in for a GCS bucket IAM policy: a set of
+// role bindings, each granting a role to a list of members.
+type IAMPolicy struct {
+	Bindings []IAMBinding
+}
+
+// IAMBinding grants Role to every member in Members.
+type IAMBinding struct {
+	Role    string
+	Members []string
+}
+
+// PreconditionOptions carries the GCS conditional-request preconditions
+// accepted by CreateObject/DeleteObject/GetObjectWithGeneration and the
+// compose/copy operations. A nil pointer for any field means that
+// precondition is not checked.
+type PreconditionOptions struct {
+	IfGenerationMatch        *int64
+	IfGenerationNotMatch     *int64
+	IfMetagenerationMatch    *int64
+	IfMetagenerationNotMatch *int64
+}
+
+// PreconditionFailedError is returned when a PreconditionOptions check
+// doesn't hold; HTTP handlers should map it to a 412 response.
+type PreconditionFailedError struct {
+	Message string
+}
+
+func (e *PreconditionFailedError) Error() string {
+	return e.Message
+}
+
+// checkPreconditions validates opts against obj (the currently-stored
+// object, which may be the zero value if none exists yet).
+func checkPreconditions(obj Object, exists bool, opts PreconditionOptions) error {
+	if opts.IfGenerationMatch != nil {
+		generation := int64(0)
+		if exists {
+			generation = obj.Generation
+		}
+		if generation != *opts.IfGenerationMatch {
+			return &PreconditionFailedError{Message: fmt.Sprintf("precondition failed: generation %d does not match %d", generation, *opts.IfGenerationMatch)}
+		}
+	}
+	if opts.IfGenerationNotMatch != nil {
+		generation := int64(0)
+		if exists {
+			generation = obj.Generation
+		}
+		if generation == *opts.IfGenerationNotMatch {
+			return &PreconditionFailedError{Message: fmt.Sprintf("precondition failed: generation matches %d", *opts.IfGenerationNotMatch)}
+		}
+	}
+	if exists && opts.IfMetagenerationMatch != nil && obj.Metageneration != *opts.IfMetagenerationMatch {
+		return &PreconditionFailedError{Message: fmt.Sprintf("precondition failed: metageneration %d does not match %d", obj.Metageneration, *opts.IfMetagenerationMatch)}
+	}
+	if exists && opts.IfMetagenerationNotMatch != nil && obj.Metageneration == *opts.IfMetagenerationNotMatch {
+		return &PreconditionFailedError{Message: fmt.Sprintf("precondition failed: metageneration matches %d", *opts.IfMetagenerationNotMatch)}
+	}
+	return nil
+}
+
+// SetIAMPolicy replaces the IAM policy of the named bucket.
+func (s *StorageMemory) SetIAMPolicy(bucketName string, policy IAMPolicy) error {
+	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	if err != nil {
+		return err
+	}
+	bucketInMemory.mtx.Lock()
+	defer bucketInMemory.mtx.Unlock()
+	bucketInMemory.IAMPolicy = policy
+	return nil
+}
+
+// GetIAMPolicy returns the IAM policy currently set on the named bucket.
+func (s *StorageMemory) GetIAMPolicy(bucketName string) (IAMPolicy, error) {
+	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	if err != nil {
+		return IAMPolicy{}, err
+	}
+	bucketInMemory.mtx.RLock()
+	defer bucketInMemory.mtx.RUnlock()
+	return bucketInMemory.IAMPolicy, nil
+}
+
+// TestIAMPermissions returns the subset of permissions that member holds
+// on the named bucket, based on its IAM policy role bindings.
+func (s *StorageMemory) TestIAMPermissions(bucketName string, member string, permissions []string) ([]string, error) {
+	policy, err := s.GetIAMPolicy(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	roles := map[string]bool{}
+	for _, binding := range policy.Bindings {
+		for _, m := range binding.Members {
+			if m == member {
+				roles[binding.Role] = true
+			}
+		}
+	}
+
+	var granted []string
+	for _, perm := range permissions {
+		if roles[rolesStorageAdmin] || roles[permissionToRole[perm]] {
+			granted = append(granted, perm)
+		}
+	}
+	return granted, nil
+}
+
+const rolesStorageAdmin = "roles/storage.admin"
+
+// permissionToRole is a minimal mapping from storage permissions to the
+// predefined role that grants them, enough to make TestIAMPermissions
+// useful for the common "can this member read/write this bucket" checks.
+var permissionToRole = map[string]string{
+	"storage.objects.get":    "roles/storage.objectViewer",
+	"storage.objects.list":   "roles/storage.objectViewer",
+	"storage.objects.create": "roles/storage.objectCreator",
+	"storage.objects.delete": "roles/storage.objectAdmin",
+}
+
+// SetObjectACL replaces the ACL of a specific object generation.
+func (s *StorageMemory) SetObjectACL(bucketName, objectName string, generation int64, acl []ObjectAccessControl) error {
+	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	if err != nil {
+		return err
+	}
+	bucketInMemory.mtx.Lock()
+	defer bucketInMemory.mtx.Unlock()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName}}
+	matchGeneration := generation != 0
+	if matchGeneration {
+		obj.Generation = generation
+	}
+	// Look in activeObjects first, then archivedObjects, keeping each
+	// candidate list the real backing slice (never an append-grown
+	// temporary) so the index below aliases the stored object instead of
+	// a throwaway copy.
+	if index := findObject(obj, bucketInMemory.activeObjects, matchGeneration); index >= 0 {
+		bucketInMemory.activeObjects[index].ACL = acl
+		return nil
+	}
+	if matchGeneration {
+		if index := findObject(obj, bucketInMemory.archivedObjects, matchGeneration); index >= 0 {
+			bucketInMemory.archivedObjects[index].ACL = acl
+			return nil
+		}
+	}
+	return fmt.Errorf("object %s/%s not found", bucketName, objectName)
+}
+
+// expandPredefinedACL turns a GCS predefinedAcl/predefinedDefaultObjectAcl
+// query parameter value into the concrete ACL entries it represents.
+func expandPredefinedACL(predefined string) []ObjectAccessControl {
+	switch predefined {
+	case "publicRead":
+		return []ObjectAccessControl{{Entity: "allUsers", Role: "READER"}}
+	case "authenticatedRead":
+		return []ObjectAccessControl{{Entity: "allAuthenticatedUsers", Role: "READER"}}
+	case "bucketOwnerFullControl":
+		return []ObjectAccessControl{{Entity: "project-owners", Role: "OWNER"}}
+	case "bucketOwnerRead":
+		return []ObjectAccessControl{{Entity: "project-owners", Role: "READER"}}
+	case "private":
+		return nil
+	default:
+		return nil
+	}
+}
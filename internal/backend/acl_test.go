@@ -0,0 +1,78 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "testing"
+
+func TestCheckPreconditions(t *testing.T) {
+	existing := Object{ObjectAttrs: ObjectAttrs{Generation: 5, Metageneration: 2}}
+
+	cases := []struct {
+		name    string
+		obj     Object
+		exists  bool
+		opts    PreconditionOptions
+		wantErr bool
+	}{
+		{"no preconditions", existing, true, PreconditionOptions{}, false},
+		{"generation match satisfied", existing, true, PreconditionOptions{IfGenerationMatch: ptrInt64(5)}, false},
+		{"generation match violated", existing, true, PreconditionOptions{IfGenerationMatch: ptrInt64(1)}, true},
+		{"create-only satisfied on absence", Object{}, false, PreconditionOptions{IfGenerationMatch: ptrInt64(0)}, false},
+		{"create-only violated when present", existing, true, PreconditionOptions{IfGenerationMatch: ptrInt64(0)}, true},
+		{"generation not-match violated", existing, true, PreconditionOptions{IfGenerationNotMatch: ptrInt64(5)}, true},
+		{"metageneration match violated", existing, true, PreconditionOptions{IfMetagenerationMatch: ptrInt64(1)}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkPreconditions(c.obj, c.exists, c.opts)
+			if c.wantErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if c.wantErr {
+				if _, ok := err.(*PreconditionFailedError); !ok {
+					t.Fatalf("expected *PreconditionFailedError, got %T", err)
+				}
+			}
+		})
+	}
+}
+
+// TestSetObjectACLOnArchivedGeneration is a regression test for the bug
+// where SetObjectACL indexed into append(activeObjects, archivedObjects...)
+// and wrote the new ACL into that throwaway slice instead of the real
+// archived object: it reported success but the change didn't persist.
+func TestSetObjectACLOnArchivedGeneration(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "o.txt"}}, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.GetObject("b", "o.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting with versioning enabled archives `first`'s generation.
+	if err := s.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "o.txt"}}, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	acl := []ObjectAccessControl{{Entity: "allUsers", Role: "READER"}}
+	if err := s.SetObjectACL("b", "o.txt", first.Generation, acl); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetObjectWithGeneration("b", "o.txt", first.Generation, PreconditionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ACL) != 1 || got.ACL[0] != acl[0] {
+		t.Fatalf("expected the archived generation's ACL to be updated, got %+v", got.ACL)
+	}
+}
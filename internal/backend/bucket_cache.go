@@ -0,0 +1,114 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultBucketCacheSize bounds how many *bucketInMemory entries the cache
+// keeps warm. It only affects how often lookups fall back to the
+// authoritative map under StorageMemory.mtx; eviction from the cache never
+// loses data.
+const defaultBucketCacheSize = 1024
+
+// defaultBucketCacheTTL is how long a cached entry is trusted before a
+// lookup re-fetches it from the authoritative map. This bounds how stale a
+// cache hit can be after a bucket is deleted and recreated.
+const defaultBucketCacheTTL = 30 * time.Second
+
+// bucketCacheEntry is the value stored in the cache's linked list.
+type bucketCacheEntry struct {
+	name      string
+	bucket    *bucketInMemory
+	expiresAt time.Time
+}
+
+// BucketCache is a bounded, TTL-expiring LRU cache of bucket lookups. It
+// sits in front of StorageMemory's authoritative bucket map so that
+// read-heavy workloads (repeated GetObject/ListObjects calls against the
+// same bucket) don't contend on the top-level map lock; the map itself
+// remains the source of truth and is only consulted on a cache miss.
+type BucketCache struct {
+	mtx      sync.Mutex
+	size     int
+	ttl      time.Duration
+	ll       *list.List
+	elements map[string]*list.Element
+}
+
+// NewBucketCache creates a BucketCache bounded to size entries, each valid
+// for ttl before being treated as a miss. A size or ttl of zero falls back
+// to the package defaults.
+func NewBucketCache(size int, ttl time.Duration) *BucketCache {
+	if size <= 0 {
+		size = defaultBucketCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultBucketCacheTTL
+	}
+	return &BucketCache{
+		size:     size,
+		ttl:      ttl,
+		ll:       list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached bucket for name, if present and not expired.
+func (c *BucketCache) Get(name string, now time.Time) (*bucketInMemory, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elem, ok := c.elements[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*bucketCacheEntry)
+	if now.After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.bucket, true
+}
+
+// Put inserts or refreshes the cached entry for name, evicting the least
+// recently used entry if the cache is at capacity.
+func (c *BucketCache) Put(name string, bucket *bucketInMemory, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.elements[name]; ok {
+		entry := elem.Value.(*bucketCacheEntry)
+		entry.bucket = bucket
+		entry.expiresAt = now.Add(c.ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+	entry := &bucketCacheEntry{name: name, bucket: bucket, expiresAt: now.Add(c.ttl)}
+	elem := c.ll.PushFront(entry)
+	c.elements[name] = elem
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Invalidate drops name from the cache, forcing the next Get to miss. It
+// must be called whenever a bucket is deleted or recreated so the cache
+// can't serve a stale pointer past its TTL.
+func (c *BucketCache) Invalidate(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.elements[name]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *BucketCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	entry := elem.Value.(*bucketCacheEntry)
+	delete(c.elements, entry.name)
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkStorageMemoryConcurrentWriters demonstrates that CreateObject
+// scales with the number of distinct buckets being written to
+// concurrently, since each write now only locks its own bucket instead of
+// a single StorageMemory-wide mutex.
+func BenchmarkStorageMemoryConcurrentWriters(b *testing.B) {
+	for _, numBuckets := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("buckets=%d", numBuckets), func(b *testing.B) {
+			s := NewStorageMemory(nil).(*StorageMemory)
+			bucketNames := make([]string, numBuckets)
+			for i := range bucketNames {
+				bucketNames[i] = fmt.Sprintf("bucket-%d", i)
+				if err := s.CreateBucket(bucketNames[i], false); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			b.SetParallelism(numBuckets)
+			var counter int32
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt32(&counter, 1)) - 1
+				bucketName := bucketNames[i%numBuckets]
+				n := 0
+				for pb.Next() {
+					obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: fmt.Sprintf("object-%d", n)}}
+					if err := s.CreateObject(obj, PreconditionOptions{}, ""); err != nil {
+						b.Fatal(err)
+					}
+					n++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/base64"
+	"hash/crc32"
+	"testing"
+)
+
+// TestComposeObjectCombinesContentAndCrc32c checks that ComposeObject
+// concatenates its sources in order and computes the CRC32C of the combined
+// content the same way GCS does, rather than e.g. reusing a source's own
+// checksum.
+func TestComposeObjectCombinesContentAndCrc32c(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateContent(t, s, "b", "part1", "hello ")
+	mustCreateContent(t, s, "b", "part2", "world")
+
+	result, err := s.ComposeObject("b", "combined", []ComposeSource{{Name: "part1"}, {Name: "part2"}}, ObjectAttrs{}, PreconditionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Content) != "hello world" {
+		t.Fatalf("expected combined content %q, got %q", "hello world", result.Content)
+	}
+	want := base64.StdEncoding.EncodeToString(crc32Bytes(crc32.Checksum([]byte("hello world"), crc32cTable)))
+	if result.Crc32c != want {
+		t.Fatalf("expected Crc32c %q, got %q", want, result.Crc32c)
+	}
+}
+
+// TestCopyObjectHonorsPreconditions checks that a CopyObject overwriting an
+// existing destination respects the destination's preconditions, the same
+// way CreateObject does for a plain write.
+func TestCopyObjectHonorsPreconditions(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+	mustCreateContent(t, s, "b", "src", "source content")
+	mustCreateContent(t, s, "b", "dst", "original content")
+
+	_, err := s.CopyObject("b", "src", 0, "b", "dst", nil, PreconditionOptions{IfGenerationMatch: ptrInt64(0)})
+	if err == nil {
+		t.Fatal("expected copying onto an existing destination with IfGenerationMatch(0) to fail")
+	}
+	if _, ok := err.(*PreconditionFailedError); !ok {
+		t.Fatalf("expected a *PreconditionFailedError, got %T: %v", err, err)
+	}
+
+	dst, err := s.GetObject("b", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dst.Content) != "original content" {
+		t.Fatalf("expected the failed copy to leave dst untouched, got %q", dst.Content)
+	}
+}
+
+func mustCreateContent(t *testing.T, s *StorageMemory, bucket, name, content string) {
+	t.Helper()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucket, Name: name}, Content: []byte(content)}
+	if err := s.CreateObject(obj, PreconditionOptions{}, ""); err != nil {
+		t.Fatalf("creating %s: %v", name, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func ptrInt64(v int64) *int64 { return &v }
+
+// TestRunLifecycleOnceDeletesAgedLiveObject exercises the "live object past
+// its Age" scenario the request names: a Delete rule with an Age condition
+// should remove a live object once it's old enough, without waiting for
+// real time to pass, by overriding the clock via SetNowFunc.
+func TestRunLifecycleOnceDeletesAgedLiveObject(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "old.txt", Created: created.Format(time.RFC3339)}}
+	if err := s.CreateObject(obj, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetBucketLifecycle("b", LifecycleConfig{Rules: []LifecycleRule{
+		{Action: LifecycleAction{Type: LifecycleActionDelete}, Conditions: LifecycleCondition{Age: ptrInt64(30)}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetNowFunc(func() time.Time { return created.AddDate(0, 0, 31) })
+
+	s.RunLifecycleOnce()
+
+	objs, err := s.ListObjects("b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 0 {
+		t.Fatalf("expected the aged object to be deleted, got %d objects", len(objs))
+	}
+}
+
+// TestRunLifecycleOncePrunesNoncurrentVersion is the headline scenario from
+// the request: a NumNewerVersions rule should prune an archived (noncurrent)
+// version without touching the live one, which was silently a no-op before
+// applyLifecycleAction learned to operate on archivedObjects.
+func TestRunLifecycleOncePrunesNoncurrentVersion(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "v.txt"}}, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting with versioning enabled archives the first generation.
+	if err := s.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "v.txt"}}, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetBucketLifecycle("b", LifecycleConfig{Rules: []LifecycleRule{
+		{Action: LifecycleAction{Type: LifecycleActionDelete}, Conditions: LifecycleCondition{NumNewerVersions: ptrInt64(1)}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.RunLifecycleOnce()
+
+	live, err := s.ListObjects("b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 {
+		t.Fatalf("expected the live object to survive, got %d", len(live))
+	}
+	all, err := s.ListObjects("b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("expected the noncurrent version to be pruned, got %d objects total", len(all))
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ListParams controls how ListObjectsPaged filters, groups and paginates
+// the objects of a bucket, mirroring the query parameters accepted by the
+// GCS JSON API's objects.list.
+type ListParams struct {
+	Prefix                   string
+	Delimiter                string
+	StartOffset              string
+	EndOffset                string
+	MaxResults               int
+	PageToken                string
+	IncludeTrailingDelimiter bool
+	Versions                 bool
+}
+
+// ListResult is the outcome of a single ListObjectsPaged call: the objects
+// for this page, the common prefixes rolled up by delimiter, and a token
+// for fetching the next page (empty once there are no more results).
+type ListResult struct {
+	Objects       []Object
+	Prefixes      []string
+	NextPageToken string
+}
+
+// ListObjectsPaged lists the objects of bucketName honoring prefix,
+// delimiter and offset filtering, grouping names that share a prefix up to
+// the next delimiter into ListResult.Prefixes, and paginating the
+// (deterministically ordered) remainder according to params.MaxResults and
+// params.PageToken.
+func (s *StorageMemory) ListObjectsPaged(bucketName string, params ListParams) (ListResult, error) {
+	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	if err != nil {
+		return ListResult{}, err
+	}
+	bucketInMemory.mtx.RLock()
+	objects := append([]Object{}, bucketInMemory.activeObjects...)
+	if params.Versions {
+		objects = append(objects, bucketInMemory.archivedObjects...)
+	}
+	bucketInMemory.mtx.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Name != objects[j].Name {
+			return objects[i].Name < objects[j].Name
+		}
+		return objects[i].Generation < objects[j].Generation
+	})
+
+	names := map[string]bool{}
+	filtered := objects[:0:0]
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, params.Prefix) {
+			continue
+		}
+		if params.StartOffset != "" && obj.Name < params.StartOffset {
+			continue
+		}
+		if params.EndOffset != "" && obj.Name >= params.EndOffset {
+			continue
+		}
+		rest := obj.Name[len(params.Prefix):]
+		if params.Delimiter != "" {
+			if idx := strings.Index(rest, params.Delimiter); idx >= 0 {
+				prefix := params.Prefix + rest[:idx+len(params.Delimiter)]
+				names[prefix] = true
+				if params.IncludeTrailingDelimiter && rest[idx+len(params.Delimiter):] == "" {
+					filtered = append(filtered, obj)
+				}
+				continue
+			}
+		}
+		filtered = append(filtered, obj)
+	}
+
+	prefixes := make([]string, 0, len(names))
+	for p := range names {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	after, err := decodePageToken(params.PageToken)
+	if err != nil {
+		return ListResult{}, err
+	}
+	start := 0
+	if after != "" {
+		for i, obj := range filtered {
+			if obj.ID() == after {
+				start = i + 1
+				break
+			}
+		}
+	}
+	page := filtered[start:]
+	nextToken := ""
+	if params.MaxResults > 0 && len(page) > params.MaxResults {
+		page = page[:params.MaxResults]
+		nextToken = encodePageToken(page[len(page)-1].ID())
+	}
+
+	return ListResult{Objects: page, Prefixes: prefixes, NextPageToken: nextToken}, nil
+}
+
+// encodePageToken and decodePageToken give ListObjectsPaged a stable,
+// opaque cursor: the name+generation of the last object returned, rather
+// than a raw slice offset. That way objects created or deleted elsewhere
+// in the sorted order between two calls don't shift which object the
+// cursor points at, so paging through a listing stays consistent even as
+// the bucket mutates mid-scan.
+func encodePageToken(lastID string) string {
+	return base64.URLEncoding.EncodeToString([]byte(lastID))
+}
+
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid page token: %w", err)
+	}
+	return string(decoded), nil
+}
@@ -13,32 +13,72 @@ import (
 
 // StorageMemory is an implementation of the backend storage that stores data in memory
 type StorageMemory struct {
-	buckets map[string]bucketInMemory
+	buckets map[string]*bucketInMemory
 	mtx     sync.RWMutex
+	// cache fronts bucket lookups so repeated reads against the same
+	// bucket don't contend on mtx; buckets is still the source of truth.
+	cache *BucketCache
+	// nowFunc, when set, overrides time.Now for lifecycle rule evaluation
+	// so tests can simulate the passage of days without sleeping.
+	nowFunc func() time.Time
+	// uploads tracks in-progress resumable/multipart uploads, keyed by
+	// session ID; see upload.go.
+	uploads    map[string]*uploadSession
+	uploadsMtx sync.RWMutex
+	// notifications holds the NotificationConfigs registered per bucket,
+	// and notifyPoolInstance the worker pool that delivers events to
+	// them asynchronously; see notification.go.
+	notifications      map[string][]NotificationConfig
+	notifyMtx          sync.RWMutex
+	notifyPoolOnce     sync.Once
+	notifyPoolInstance *notifyWorkerPool
 }
 
 type bucketInMemory struct {
+	// mtx guards activeObjects, archivedObjects and LifecycleConfig so
+	// object mutations only need to lock the bucket they touch, not
+	// StorageMemory.mtx.
+	mtx sync.RWMutex
 	Bucket
 	activeObjects   []Object
 	archivedObjects []Object
+	LifecycleConfig LifecycleConfig
+	IAMPolicy       IAMPolicy
 }
 
-func newBucketInMemory(name string, versioningEnabled bool) bucketInMemory {
-	return bucketInMemory{Bucket{name, versioningEnabled, time.Now()}, []Object{}, []Object{}}
+func newBucketInMemory(name string, versioningEnabled bool) *bucketInMemory {
+	return &bucketInMemory{
+		Bucket:          Bucket{name, versioningEnabled, time.Now()},
+		activeObjects:   []Object{},
+		archivedObjects: []Object{},
+	}
+}
+
+func (bm *bucketInMemory) addObject(obj Object) (archivedPrevious bool) {
+	bm.mtx.Lock()
+	defer bm.mtx.Unlock()
+	return bm.addObjectLocked(obj)
 }
 
-func (bm *bucketInMemory) addObject(obj Object) {
+// addObjectLocked is addObject's logic without acquiring bm.mtx, for
+// callers (such as CreateObject, ComposeObject and CopyObject) that already
+// hold it. It reports
+// whether a previous version of the object was moved into archivedObjects,
+// so callers can fire an OBJECT_ARCHIVE notification.
+func (bm *bucketInMemory) addObjectLocked(obj Object) (archivedPrevious bool) {
 	obj.Generation = getNewGenerationIfZero(obj.Generation)
 	index := findObject(obj, bm.activeObjects, false)
 	if index >= 0 {
 		if bm.VersioningEnabled {
 			bm.activeObjects[index].Deleted = time.Now().Format(time.RFC3339)
 			bm.cpToArchive(bm.activeObjects[index])
+			archivedPrevious = true
 		}
 		bm.activeObjects[index] = obj
 	} else {
 		bm.activeObjects = append(bm.activeObjects, obj)
 	}
+	return archivedPrevious
 }
 
 func getNewGenerationIfZero(generation int64) int64 {
@@ -48,7 +88,9 @@ func getNewGenerationIfZero(generation int64) int64 {
 	return generation
 }
 
-func (bm *bucketInMemory) deleteObject(obj Object, matchGeneration bool) {
+// deleteObjectLocked removes obj from the bucket (archiving it first if
+// versioning is enabled). The caller must already hold bm.mtx for writing.
+func (bm *bucketInMemory) deleteObjectLocked(obj Object, matchGeneration bool) {
 	index := findObject(obj, bm.activeObjects, matchGeneration)
 	if index < 0 {
 		return
@@ -101,13 +143,13 @@ func findObject(obj Object, objectList []Object, matchGeneration bool) int {
 // NewStorageMemory creates an instance of StorageMemory
 func NewStorageMemory(objects []Object) Storage {
 	s := &StorageMemory{
-		buckets: make(map[string]bucketInMemory),
+		buckets: make(map[string]*bucketInMemory),
+		cache:   NewBucketCache(defaultBucketCacheSize, defaultBucketCacheTTL),
 	}
 	for _, o := range objects {
 		s.CreateBucket(o.BucketName, false)
-		bucket := s.buckets[o.BucketName]
+		bucket, _ := s.getBucketInMemory(o.BucketName)
 		bucket.addObject(o)
-		s.buckets[o.BucketName] = bucket
 	}
 	return s
 }
@@ -116,14 +158,14 @@ func NewStorageMemory(objects []Object) Storage {
 func (s *StorageMemory) CreateBucket(name string, versioningEnabled bool) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	bucket, err := s.getBucketInMemory(name)
-	if err == nil {
+	if bucket, found := s.buckets[name]; found {
 		if bucket.VersioningEnabled != versioningEnabled {
 			return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
 		}
 		return nil
 	}
 	s.buckets[name] = newBucketInMemory(name, versioningEnabled)
+	s.cache.Invalidate(name)
 	return nil
 }
 
@@ -140,40 +182,83 @@ func (s *StorageMemory) ListBuckets() ([]Bucket, error) {
 
 // GetBucket checks if a bucket exists
 func (s *StorageMemory) GetBucket(name string) (Bucket, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
 	bucketInMemory, err := s.getBucketInMemory(name)
-	return Bucket{bucketInMemory.Name, bucketInMemory.VersioningEnabled, bucketInMemory.TimeCreated}, err
+	if err != nil {
+		return Bucket{}, err
+	}
+	return Bucket{bucketInMemory.Name, bucketInMemory.VersioningEnabled, bucketInMemory.TimeCreated}, nil
 }
 
-func (s *StorageMemory) getBucketInMemory(name string) (bucketInMemory, error) {
-	if bucketInMemory, found := s.buckets[name]; found {
-		return bucketInMemory, nil
+// getBucketInMemory resolves a bucket by name, consulting the cache before
+// falling back to the authoritative map under s.mtx.
+func (s *StorageMemory) getBucketInMemory(name string) (*bucketInMemory, error) {
+	now := s.now()
+	if bucket, ok := s.cache.Get(name, now); ok {
+		return bucket, nil
 	}
-	return bucketInMemory{}, fmt.Errorf("no bucket named %s", name)
+	s.mtx.RLock()
+	bucket, found := s.buckets[name]
+	s.mtx.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("no bucket named %s", name)
+	}
+	s.cache.Put(name, bucket, now)
+	return bucket, nil
 }
 
-// CreateObject stores an object
-func (s *StorageMemory) CreateObject(obj Object) error {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	bucketInMemory, err := s.getBucketInMemory(obj.BucketName)
+// CreateObject stores an object, honoring opts' preconditions and, when
+// predefinedACL is non-empty and obj doesn't already carry an ACL,
+// expanding it into concrete ACL entries. The precondition check and the
+// write happen under a single lock on obj's bucket, so two concurrent
+// CreateObject calls racing the same precondition (e.g. both using
+// IfGenerationMatch(0) to mean "create only if absent") can't both
+// succeed.
+func (s *StorageMemory) CreateObject(obj Object, opts PreconditionOptions, predefinedACL string) error {
+	bucket, err := s.getBucketInMemory(obj.BucketName)
 	if err != nil {
-		bucketInMemory = newBucketInMemory(obj.BucketName, false)
+		bucket = s.getOrCreateBucketInMemory(obj.BucketName)
+	}
+	bucket.mtx.Lock()
+	defer bucket.mtx.Unlock()
+
+	existing, exists := bucket.findObjectLocked(obj.Name, 0)
+	if err := checkPreconditions(existing, exists, opts); err != nil {
+		return err
+	}
+	if predefinedACL != "" && len(obj.ACL) == 0 {
+		obj.ACL = expandPredefinedACL(predefinedACL)
 	}
-	bucketInMemory.addObject(obj)
-	s.buckets[obj.BucketName] = bucketInMemory
+
+	archivedPrevious := bucket.addObjectLocked(obj)
+	if archivedPrevious {
+		s.notify(Event{Bucket: obj.BucketName, Name: obj.Name, Generation: obj.Generation, EventType: EventArchive, PayloadFormat: "JSON_API_V1"})
+	}
+	s.notify(Event{Bucket: obj.BucketName, Name: obj.Name, Generation: obj.Generation, EventType: EventFinalize, PayloadFormat: "JSON_API_V1"})
 	return nil
 }
 
+// getOrCreateBucketInMemory returns the named bucket, creating it
+// unversioned first if it doesn't already exist.
+func (s *StorageMemory) getOrCreateBucketInMemory(name string) *bucketInMemory {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	bucket, found := s.buckets[name]
+	if !found {
+		bucket = newBucketInMemory(name, false)
+		s.buckets[name] = bucket
+		s.cache.Invalidate(name)
+	}
+	return bucket
+}
+
 // ListObjects lists the objects in a given bucket with a given prefix and delimeter
 func (s *StorageMemory) ListObjects(bucketName string, versions bool) ([]Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
 	bucketInMemory, err := s.getBucketInMemory(bucketName)
 	if err != nil {
 		return []Object{}, err
 	}
+	bucketInMemory.mtx.RLock()
+	defer bucketInMemory.mtx.RUnlock()
 	if !versions {
 		return bucketInMemory.activeObjects, nil
 	}
@@ -182,45 +267,72 @@ func (s *StorageMemory) ListObjects(bucketName string, versions bool) ([]Object,
 
 // GetObject get an object by bucket and name
 func (s *StorageMemory) GetObject(bucketName, objectName string) (Object, error) {
-	return s.GetObjectWithGeneration(bucketName, objectName, 0)
+	return s.GetObjectWithGeneration(bucketName, objectName, 0, PreconditionOptions{})
 }
 
-// GetObjectWithGeneration retrieves an specific version of the object
-func (s *StorageMemory) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
+// GetObjectWithGeneration retrieves an specific version of the object,
+// honoring opts' preconditions (e.g. IfGenerationMatch for a conditional
+// read that must fail if the object has moved on since the caller last
+// observed it).
+func (s *StorageMemory) GetObjectWithGeneration(bucketName, objectName string, generation int64, opts PreconditionOptions) (Object, error) {
 	bucketInMemory, err := s.getBucketInMemory(bucketName)
 	if err != nil {
 		return Object{}, err
 	}
+	bucketInMemory.mtx.RLock()
+	defer bucketInMemory.mtx.RUnlock()
+	obj, found := bucketInMemory.findObjectLocked(objectName, generation)
+	if !found {
+		if err := checkPreconditions(Object{}, false, opts); err != nil {
+			return Object{}, err
+		}
+		return Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation}}, errors.New("object not found")
+	}
+	if err := checkPreconditions(obj, true, opts); err != nil {
+		return Object{}, err
+	}
+	return obj, nil
+}
+
+// findObjectLocked resolves objectName (at generation, or the live version
+// if generation is zero) against bm's lists. The caller must already hold
+// bm.mtx for reading or writing.
+func (bm *bucketInMemory) findObjectLocked(objectName string, generation int64) (Object, bool) {
 	matchGeneration := false
-	obj := Object{BucketName: bucketName, Name: objectName}
-	listToConsider := bucketInMemory.activeObjects
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bm.Name, Name: objectName}}
+	listToConsider := bm.activeObjects
 	if generation != 0 {
 		matchGeneration = true
 		obj.Generation = generation
-		listToConsider = append(listToConsider, bucketInMemory.archivedObjects...)
+		listToConsider = append(listToConsider, bm.archivedObjects...)
 	}
 	index := findObject(obj, listToConsider, matchGeneration)
 	if index < 0 {
-		return obj, errors.New("object not found")
+		return Object{}, false
 	}
-	return listToConsider[index], nil
+	return listToConsider[index], true
 }
 
-// DeleteObject deletes an object by bucket and name
-func (s *StorageMemory) DeleteObject(bucketName, objectName string) error {
-	obj, err := s.GetObject(bucketName, objectName)
+// DeleteObject deletes an object by bucket and name, honoring opts'
+// preconditions. The precondition check and the delete happen under a
+// single lock on the bucket, so a concurrent CreateObject/DeleteObject
+// racing the same precondition can't both observe it as satisfied.
+func (s *StorageMemory) DeleteObject(bucketName, objectName string, opts PreconditionOptions) error {
+	bucketInMemory, err := s.getBucketInMemory(bucketName)
 	if err != nil {
 		return err
 	}
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	bucketInMemory, err := s.getBucketInMemory(bucketName)
-	if err != nil {
+	bucketInMemory.mtx.Lock()
+	defer bucketInMemory.mtx.Unlock()
+
+	obj, found := bucketInMemory.findObjectLocked(objectName, 0)
+	if !found {
+		return errors.New("object not found")
+	}
+	if err := checkPreconditions(obj, true, opts); err != nil {
 		return err
 	}
-	bucketInMemory.deleteObject(obj, true)
-	s.buckets[bucketName] = bucketInMemory
+	bucketInMemory.deleteObjectLocked(obj, true)
+	s.notify(Event{Bucket: bucketName, Name: objectName, Generation: obj.Generation, EventType: EventDelete, PayloadFormat: "JSON_API_V1"})
 	return nil
 }
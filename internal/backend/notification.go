@@ -0,0 +1,247 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventType identifies the kind of object mutation a notification fires
+// for, mirroring GCS Pub/Sub object notification event types.
+type EventType string
+
+const (
+	EventFinalize       EventType = "OBJECT_FINALIZE"
+	EventMetadataUpdate EventType = "OBJECT_METADATA_UPDATE"
+	EventDelete         EventType = "OBJECT_DELETE"
+	EventArchive        EventType = "OBJECT_ARCHIVE"
+)
+
+// Event describes a single object mutation, in the same shape GCS uses for
+// its Pub/Sub notification payloads.
+type Event struct {
+	Bucket         string    `json:"bucket"`
+	Name           string    `json:"name"`
+	Generation     int64     `json:"generation,string"`
+	Metageneration int64     `json:"metageneration,string"`
+	EventType      EventType `json:"eventType"`
+	PayloadFormat  string    `json:"payloadFormat"`
+}
+
+// Notifier delivers Events to whatever subscriber registered a
+// NotificationConfig. Implementations must be safe for concurrent use and
+// should not block the caller of Notify for longer than it takes to
+// enqueue the event.
+type Notifier interface {
+	Notify(Event)
+}
+
+// NotificationConfig is what RegisterNotification stores for a bucket: a
+// Notifier plus the filters that decide which events reach it.
+type NotificationConfig struct {
+	Notifier         Notifier
+	EventTypes       []EventType
+	ObjectNamePrefix string
+	ObjectNameSuffix string
+}
+
+func (cfg NotificationConfig) matches(evt Event) bool {
+	if len(cfg.EventTypes) > 0 {
+		matched := false
+		for _, t := range cfg.EventTypes {
+			if t == evt.EventType {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if cfg.ObjectNamePrefix != "" && !strings.HasPrefix(evt.Name, cfg.ObjectNamePrefix) {
+		return false
+	}
+	if cfg.ObjectNameSuffix != "" && !strings.HasSuffix(evt.Name, cfg.ObjectNameSuffix) {
+		return false
+	}
+	return true
+}
+
+// RegisterNotification adds cfg as a subscriber for events on bucket. A
+// bucket may have any number of registered configs; all matching ones are
+// notified.
+func (s *StorageMemory) RegisterNotification(bucket string, cfg NotificationConfig) {
+	s.notifyMtx.Lock()
+	defer s.notifyMtx.Unlock()
+	if s.notifications == nil {
+		s.notifications = make(map[string][]NotificationConfig)
+	}
+	s.notifications[bucket] = append(s.notifications[bucket], cfg)
+}
+
+// notify delivers evt to every NotificationConfig registered for
+// evt.Bucket whose filters match, via the bounded worker pool so a slow or
+// unreachable subscriber can't block the write that triggered the event.
+func (s *StorageMemory) notify(evt Event) {
+	s.notifyMtx.RLock()
+	configs := s.notifications[evt.Bucket]
+	s.notifyMtx.RUnlock()
+	if len(configs) == 0 {
+		return
+	}
+	pool := s.notifyPool()
+	for _, cfg := range configs {
+		if !cfg.matches(evt) {
+			continue
+		}
+		pool.submit(cfg.Notifier, evt)
+	}
+}
+
+func (s *StorageMemory) notifyPool() *notifyWorkerPool {
+	s.notifyPoolOnce.Do(func() {
+		s.notifyPoolInstance = newNotifyWorkerPool(8)
+	})
+	return s.notifyPoolInstance
+}
+
+// ChannelNotifier delivers events to a Go channel, intended for tests that
+// want to assert on notifications synchronously.
+type ChannelNotifier chan Event
+
+func (c ChannelNotifier) Notify(evt Event) {
+	c <- evt
+}
+
+// WebhookNotifier POSTs a GCS-compatible JSON payload to URL for every
+// event it receives.
+type WebhookNotifier struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+func (w WebhookNotifier) Notify(evt Event) {
+	client := w.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	// Best effort: a transport error or a non-2xx response is dropped
+	// here and not reported to the worker pool, so such a delivery is not
+	// retried.
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(payload))
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// PubSubNotifier publishes events to a topic on a Cloud Pub/Sub emulator
+// (or any server implementing its REST publish endpoint): message data is
+// evt's JSON payload, base64-encoded per the Pub/Sub wire format. No
+// message attributes are set.
+type PubSubNotifier struct {
+	// EmulatorHost is the emulator's host:port, e.g. the value of
+	// $PUBSUB_EMULATOR_HOST.
+	EmulatorHost string
+	ProjectID    string
+	Topic        string
+	HTTPClient   *http.Client
+}
+
+func (p PubSubNotifier) Notify(evt Event) {
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]interface{}{
+			{"data": base64.StdEncoding.EncodeToString(payload)},
+		},
+	})
+	if err != nil {
+		return
+	}
+	url := fmt.Sprintf("http://%s/v1/projects/%s/topics/%s:publish", p.EmulatorHost, p.ProjectID, p.Topic)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// notifyWorkerPool delivers events asynchronously across a fixed number of
+// goroutines so one slow subscriber can't stall writers or starve other
+// subscribers. A delivery whose Notify panics is retried with backoff;
+// Notify has no other way to report a failure.
+type notifyWorkerPool struct {
+	jobs chan notifyJob
+}
+
+type notifyJob struct {
+	notifier Notifier
+	event    Event
+}
+
+func newNotifyWorkerPool(workers int) *notifyWorkerPool {
+	p := &notifyWorkerPool{jobs: make(chan notifyJob, 1024)}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *notifyWorkerPool) run() {
+	for job := range p.jobs {
+		deliverWithBackoff(job.notifier, job.event)
+	}
+}
+
+func (p *notifyWorkerPool) submit(notifier Notifier, evt Event) {
+	select {
+	case p.jobs <- notifyJob{notifier: notifier, event: evt}:
+	default:
+		// The queue is full; drop the event rather than block the
+		// write path. Subscribers are best-effort, same as GCS Pub/Sub
+		// notifications under sustained backpressure.
+	}
+}
+
+const notifyMaxRetries = 3
+
+func deliverWithBackoff(notifier Notifier, evt Event) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; attempt < notifyMaxRetries; attempt++ {
+		if notifyOnce(notifier, evt) {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notifyOnce calls notifier.Notify, recovering from a panic so that a
+// misbehaving subscriber is treated as a failed delivery instead of
+// crashing the worker pool.
+func notifyOnce(notifier Notifier, evt Event) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	notifier.Notify(evt)
+	return true
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNotifyFiltersByEventTypeAndPrefix checks that a NotificationConfig's
+// EventTypes and ObjectNamePrefix filters are actually applied before an
+// event reaches a Notifier, rather than every registered config receiving
+// every event on the bucket.
+func TestNotifyFiltersByEventTypeAndPrefix(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	matching := make(ChannelNotifier, 1)
+	s.RegisterNotification("b", NotificationConfig{
+		Notifier:         matching,
+		EventTypes:       []EventType{EventFinalize},
+		ObjectNamePrefix: "logs/",
+	})
+	nonMatching := make(ChannelNotifier, 1)
+	s.RegisterNotification("b", NotificationConfig{
+		Notifier:         nonMatching,
+		EventTypes:       []EventType{EventDelete},
+		ObjectNamePrefix: "logs/",
+	})
+	otherPrefix := make(ChannelNotifier, 1)
+	s.RegisterNotification("b", NotificationConfig{
+		Notifier:         otherPrefix,
+		EventTypes:       []EventType{EventFinalize},
+		ObjectNamePrefix: "other/",
+	})
+
+	if err := s.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "b", Name: "logs/a.txt"}}, PreconditionOptions{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case evt := <-matching:
+		if evt.Name != "logs/a.txt" || evt.EventType != EventFinalize {
+			t.Fatalf("unexpected event delivered: %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the matching config to receive the finalize event")
+	}
+
+	select {
+	case evt := <-nonMatching:
+		t.Fatalf("expected the delete-only config not to receive a finalize event, got %+v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case evt := <-otherPrefix:
+		t.Fatalf("expected the other/-prefix config not to receive an event for logs/a.txt, got %+v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultUploadSessionTTL is how long an upload session may sit idle (no
+// AppendUploadChunk/CompleteUpload call) before the sweeper expires it,
+// mirroring GCS's abandonment of stale resumable sessions.
+const defaultUploadSessionTTL = 1 * time.Hour
+
+// uploadSession tracks the state of a single in-progress resumable/
+// multipart upload. It supports two disjoint usage patterns against the
+// same session:
+//
+//   - sequential resumable uploads via AppendUploadChunk/CompleteUpload,
+//     where chunks are appended in order and committedBytes is what gets
+//     reported back for "308 Resume Incomplete" responses;
+//   - S3-style multipart uploads via UploadPart/CompleteMultipartUpload,
+//     where parts may be uploaded concurrently and in any order, each
+//     identified by an ETag that CompleteMultipartUpload verifies before
+//     reassembling them in part-number order.
+type uploadSession struct {
+	mtx            sync.Mutex
+	bucket         string
+	object         string
+	meta           ObjectAttrs
+	data           []byte
+	committedBytes int64
+	parts          map[int]uploadPart
+	done           bool
+	aborted        bool
+	lastActivity   time.Time
+}
+
+// uploadPart is a single part stored by UploadPart, pending reassembly by
+// CompleteMultipartUpload.
+type uploadPart struct {
+	data []byte
+	etag string
+}
+
+// CompletedPart identifies one previously uploaded part by number and the
+// ETag UploadPart returned for it, the same pair S3/GCS multipart complete
+// requests use to confirm which parts (and which version of each, if
+// re-uploaded) to reassemble.
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// CreateUploadSession starts a new resumable upload for bucket/object and
+// returns an opaque session ID to pass to AppendUploadChunk/CompleteUpload/
+// AbortUpload.
+func (s *StorageMemory) CreateUploadSession(bucket, object string, meta ObjectAttrs) (string, error) {
+	if _, err := s.getBucketInMemory(bucket); err != nil {
+		return "", err
+	}
+	sessionID, err := newUploadSessionID()
+	if err != nil {
+		return "", err
+	}
+	s.uploadsMtx.Lock()
+	defer s.uploadsMtx.Unlock()
+	if s.uploads == nil {
+		s.uploads = make(map[string]*uploadSession)
+	}
+	s.uploads[sessionID] = &uploadSession{
+		bucket:       bucket,
+		object:       object,
+		meta:         meta,
+		lastActivity: time.Now(),
+	}
+	return sessionID, nil
+}
+
+// AppendUploadChunk appends data at offset to the session identified by
+// sessionID. offset must equal the number of bytes already committed;
+// mismatches are rejected the same way GCS rejects a non-contiguous
+// Content-Range. It returns the total number of bytes committed so far.
+func (s *StorageMemory) AppendUploadChunk(sessionID string, offset int64, data []byte, final bool) (int64, error) {
+	session, err := s.getUploadSession(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	if session.done || session.aborted {
+		return 0, fmt.Errorf("upload session %s is no longer active", sessionID)
+	}
+	if offset != session.committedBytes {
+		return session.committedBytes, fmt.Errorf("non-contiguous chunk: expected offset %d, got %d", session.committedBytes, offset)
+	}
+	session.data = append(session.data, data...)
+	session.committedBytes += int64(len(data))
+	session.lastActivity = time.Now()
+	if final {
+		session.done = true
+	}
+	return session.committedBytes, nil
+}
+
+// CompleteUpload finalizes sessionID, materializing its accumulated bytes
+// as an Object in the bucket, and returns that Object.
+func (s *StorageMemory) CompleteUpload(sessionID string) (Object, error) {
+	session, err := s.getUploadSession(sessionID)
+	if err != nil {
+		return Object{}, err
+	}
+	session.mtx.Lock()
+	if session.aborted {
+		session.mtx.Unlock()
+		return Object{}, fmt.Errorf("upload session %s was aborted", sessionID)
+	}
+	obj := Object{
+		ObjectAttrs: session.meta,
+		Content:     append([]byte{}, session.data...),
+	}
+	obj.BucketName = session.bucket
+	obj.Name = session.object
+	session.done = true
+	session.mtx.Unlock()
+
+	if err := s.CreateObject(obj, PreconditionOptions{}, ""); err != nil {
+		return Object{}, err
+	}
+
+	s.uploadsMtx.Lock()
+	delete(s.uploads, sessionID)
+	s.uploadsMtx.Unlock()
+
+	return s.GetObject(session.bucket, session.object)
+}
+
+// UploadPart stores data as partNumber of sessionID, independently of any
+// other part, so callers may upload parts concurrently and out of order.
+// It returns an ETag that must be passed back to CompleteMultipartUpload
+// to confirm which version of that part to use.
+func (s *StorageMemory) UploadPart(sessionID string, partNumber int, data []byte) (string, error) {
+	session, err := s.getUploadSession(sessionID)
+	if err != nil {
+		return "", err
+	}
+	session.mtx.Lock()
+	defer session.mtx.Unlock()
+	if session.done || session.aborted {
+		return "", fmt.Errorf("upload session %s is no longer active", sessionID)
+	}
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+	if session.parts == nil {
+		session.parts = make(map[int]uploadPart)
+	}
+	session.parts[partNumber] = uploadPart{data: append([]byte{}, data...), etag: etag}
+	session.lastActivity = time.Now()
+	return etag, nil
+}
+
+// CompleteMultipartUpload reassembles the parts named in parts, in
+// part-number order, into an Object stored in the bucket. Every entry's
+// ETag must match the one UploadPart returned for that part number, the
+// same way S3/GCS reject a complete request referencing a stale or
+// mistyped ETag.
+func (s *StorageMemory) CompleteMultipartUpload(sessionID string, parts []CompletedPart) (Object, error) {
+	session, err := s.getUploadSession(sessionID)
+	if err != nil {
+		return Object{}, err
+	}
+	session.mtx.Lock()
+	if session.aborted {
+		session.mtx.Unlock()
+		return Object{}, fmt.Errorf("upload session %s was aborted", sessionID)
+	}
+	sorted := append([]CompletedPart{}, parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PartNumber < sorted[j].PartNumber })
+
+	var content []byte
+	for _, p := range sorted {
+		part, ok := session.parts[p.PartNumber]
+		if !ok {
+			session.mtx.Unlock()
+			return Object{}, fmt.Errorf("upload session %s has no part %d", sessionID, p.PartNumber)
+		}
+		if part.etag != p.ETag {
+			session.mtx.Unlock()
+			return Object{}, fmt.Errorf("upload session %s part %d: etag %s does not match uploaded etag %s", sessionID, p.PartNumber, p.ETag, part.etag)
+		}
+		content = append(content, part.data...)
+	}
+
+	obj := Object{ObjectAttrs: session.meta, Content: content}
+	obj.BucketName = session.bucket
+	obj.Name = session.object
+	session.done = true
+	session.mtx.Unlock()
+
+	if err := s.CreateObject(obj, PreconditionOptions{}, ""); err != nil {
+		return Object{}, err
+	}
+
+	s.uploadsMtx.Lock()
+	delete(s.uploads, sessionID)
+	s.uploadsMtx.Unlock()
+
+	return s.GetObject(session.bucket, session.object)
+}
+
+// AbortUpload discards sessionID without materializing an object.
+func (s *StorageMemory) AbortUpload(sessionID string) error {
+	session, err := s.getUploadSession(sessionID)
+	if err != nil {
+		return err
+	}
+	session.mtx.Lock()
+	session.aborted = true
+	session.mtx.Unlock()
+
+	s.uploadsMtx.Lock()
+	delete(s.uploads, sessionID)
+	s.uploadsMtx.Unlock()
+	return nil
+}
+
+func (s *StorageMemory) getUploadSession(sessionID string) (*uploadSession, error) {
+	s.uploadsMtx.RLock()
+	defer s.uploadsMtx.RUnlock()
+	session, found := s.uploads[sessionID]
+	if !found {
+		return nil, fmt.Errorf("no upload session named %s", sessionID)
+	}
+	return session, nil
+}
+
+// StartUploadSweeper starts a background goroutine that expires upload
+// sessions idle for longer than ttl (or defaultUploadSessionTTL if ttl is
+// zero). The returned func stops the sweeper.
+func (s *StorageMemory) StartUploadSweeper(tick, ttl time.Duration) (stop func()) {
+	if ttl <= 0 {
+		ttl = defaultUploadSessionTTL
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweepUploadSessions(ttl)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *StorageMemory) sweepUploadSessions(ttl time.Duration) {
+	now := time.Now()
+	s.uploadsMtx.Lock()
+	defer s.uploadsMtx.Unlock()
+	for id, session := range s.uploads {
+		session.mtx.Lock()
+		expired := now.Sub(session.lastActivity) > ttl
+		session.mtx.Unlock()
+		if expired {
+			delete(s.uploads, id)
+		}
+	}
+}
+
+func newUploadSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating upload session id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
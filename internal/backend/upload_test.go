@@ -0,0 +1,80 @@
+// Copyright 2018 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import "testing"
+
+// TestAppendUploadChunkRejectsNonContiguousOffset covers the sequential
+// resumable-upload path: a chunk whose offset doesn't match what's already
+// committed must be rejected, the same way GCS rejects a non-contiguous
+// Content-Range on a resumable upload.
+func TestAppendUploadChunkRejectsNonContiguousOffset(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err := s.CreateUploadSession("b", "o.txt", ObjectAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AppendUploadChunk(sessionID, 5, []byte("hello"), false); err == nil {
+		t.Fatal("expected a non-contiguous offset to be rejected")
+	}
+	committed, err := s.AppendUploadChunk(sessionID, 0, []byte("hello"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed != 5 {
+		t.Fatalf("expected 5 committed bytes, got %d", committed)
+	}
+	obj, err := s.CompleteUpload(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "hello" {
+		t.Fatalf("expected content %q, got %q", "hello", obj.Content)
+	}
+}
+
+// TestCompleteMultipartUploadValidatesETags is the scenario the request
+// names: parts are uploaded independently (here sequentially, but nothing
+// requires order) and CompleteMultipartUpload must reject a request quoting
+// the wrong ETag for a part instead of silently reassembling stale data.
+func TestCompleteMultipartUploadValidatesETags(t *testing.T) {
+	s := NewStorageMemory(nil).(*StorageMemory)
+	if err := s.CreateBucket("b", false); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err := s.CreateUploadSession("b", "o.txt", ObjectAttrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag2, err := s.UploadPart(sessionID, 2, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag1, err := s.UploadPart(sessionID, 1, []byte("hello "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.CompleteMultipartUpload(sessionID, []CompletedPart{
+		{PartNumber: 1, ETag: etag1},
+		{PartNumber: 2, ETag: "not-the-real-etag"},
+	}); err == nil {
+		t.Fatal("expected a mismatched ETag to be rejected")
+	}
+
+	obj, err := s.CompleteMultipartUpload(sessionID, []CompletedPart{
+		{PartNumber: 2, ETag: etag2},
+		{PartNumber: 1, ETag: etag1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "hello world" {
+		t.Fatalf("expected parts reassembled in part-number order, got %q", obj.Content)
+	}
+}